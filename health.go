@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chat ids seen per available id, used for pushing health alerts
+var knownChatIDs = map[string]int64{}
+var chatIDsLock sync.Mutex
+
+// start (or restart) the health supervisor goroutine; any previously
+// running supervisor is stopped first
+func restartSupervisor() {
+	haltSupervisor()
+
+	stopSupervisor = make(chan bool, 1)
+	go superviseTunnels(stopSupervisor)
+}
+
+// stop the health supervisor goroutine, if one is running
+func haltSupervisor() {
+	if stopSupervisor != nil {
+		stopSupervisor <- true
+		stopSupervisor = nil
+	}
+}
+
+// poll every managed instance every `healthCheckInterval` seconds and react
+// to tunnels going down
+func superviseTunnels(stop chan bool) {
+	ticker := time.NewTicker(time.Duration(healthCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, inst := range manager.List() {
+				checkInstance(inst)
+			}
+		}
+	}
+}
+
+// probe a single instance's tunnels, restarting it on the first sign of trouble
+func checkInstance(inst *tunnelInstance) {
+	tunnels, err := tunnelsStatus(inst.WebAddr)
+	if err != nil {
+		if isVerbose {
+			_stderr.Printf("health check: failed to fetch tunnels status of %s: %s", inst.Name, err)
+		}
+		handleTunnelDown(inst, fmt.Sprintf("%s (unreachable: %s)", inst.Name, err))
+		return
+	}
+
+	for _, tunnel := range tunnels.Tunnels {
+		if !probeTunnel(tunnel) {
+			handleTunnelDown(inst, fmt.Sprintf("%s (%s)", tunnel.Name, tunnel.PublicURL))
+			return
+		}
+	}
+}
+
+// probe a single tunnel's liveness: HTTP HEAD for http/https tunnels,
+// TCP dial for tcp tunnels
+func probeTunnel(tunnel ngrokTunnel) bool {
+	timeout := time.Duration(healthCheckTimeout) * time.Second
+
+	switch {
+	case strings.HasPrefix(tunnel.Proto, "http"):
+		client := http.Client{Timeout: timeout}
+		res, err := client.Head(tunnel.PublicURL)
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		return true
+	case tunnel.Proto == "tcp":
+		addr := strings.TrimPrefix(tunnel.PublicURL, "tcp://")
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	// unknown protocol: assume healthy
+	return true
+}
+
+// react to an instance going down: always attempt a restart (until
+// `maxRestartAttempts` is reached, if set), and also alert available ids when
+// `alertOnFailure` is set; there is no alert-only mode
+func handleTunnelDown(inst *tunnelInstance, detail string) {
+	_stderr.Printf("health check: tunnel down: %s", detail)
+
+	if alertOnFailure {
+		alertAll(fmt.Sprintf("Tunnel down: %s", detail))
+	}
+
+	if id, message, success := manager.AttemptRestart(inst); success {
+		if isVerbose {
+			_stdout.Printf("health check: restarted %s as %s", inst.Name, id)
+		}
+	} else {
+		_stderr.Printf("health check: restart failed: %s", message)
+
+		if alertOnFailure {
+			alertAll(fmt.Sprintf("Restart failed: %s", message))
+		}
+	}
+}
+
+// push a message to every available id that has previously messaged the bot
+// (chat ids are only known once a user's update has been seen)
+func alertAll(message string) {
+	if botClient == nil {
+		return
+	}
+
+	chatIDsLock.Lock()
+	defer chatIDsLock.Unlock()
+
+	for _, id := range availableIds {
+		if chatID, exists := knownChatIDs[id]; exists {
+			if sent := botClient.SendMessage(chatID, message, nil); !sent.Ok {
+				_stderr.Printf("alert: failed to send message to %s: %s", id, *sent.Description)
+			}
+		}
+	}
+}
+
+// build the message for the `/status` command
+func statusMessage() string {
+	instances := manager.List()
+	if len(instances) <= 0 {
+		return messageNotLaunchedYet
+	}
+
+	status := ""
+	for _, inst := range instances {
+		tunnels, err := tunnelsStatus(inst.WebAddr)
+		if err != nil {
+			status += fmt.Sprintf("â–¸ %s (failed to get tunnels status: %s)\n", inst.Name, err)
+			continue
+		}
+
+		for _, tunnel := range tunnels.Tunnels {
+			status += fmt.Sprintf("â–¸ %s\n    %s\n", tunnel.Name, tunnel.PublicURL)
+		}
+		status += fmt.Sprintf("    uptime: %s\n", time.Since(inst.LaunchedAt).Round(time.Second))
+	}
+
+	return status
+}
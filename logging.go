@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const logFileMaxSizeMB = 10
+
+// leveledLogger adapts logrus.Logger to the `Printf`-only interface that the
+// rest of this codebase was written against, while still dispatching at a
+// fixed level.
+type leveledLogger struct {
+	logger *logrus.Logger
+	level  logrus.Level
+}
+
+func (l leveledLogger) Printf(format string, args ...interface{}) {
+	l.logger.Logf(l.level, format, args...)
+}
+
+// configureLogging sets up `logger`'s level, format, and sinks from `cfg`.
+func configureLogging(cfg config) {
+	level := cfg.LogLevel
+	if len(level) <= 0 {
+		if cfg.IsVerbose { // back-compat shim for the deprecated IsVerbose flag
+			level = "debug"
+		} else {
+			level = defaultLogLevel
+		}
+	}
+	if parsed, err := logrus.ParseLevel(level); err == nil {
+		logger.SetLevel(parsed)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	format := cfg.LogFormat
+	if len(format) <= 0 {
+		format = defaultLogFormat
+	}
+	if format == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{})
+	}
+
+	logger.SetOutput(os.Stdout) // match the baseline's stdout-for-info convention
+	if len(cfg.LogFilePath) > 0 {
+		logger.SetOutput(io.MultiWriter(os.Stdout, &lumberjack.Logger{
+			Filename: cfg.LogFilePath,
+			MaxSize:  logFileMaxSizeMB,
+		}))
+	}
+
+	if cfg.LogTelegramChatID != 0 {
+		logger.AddHook(&telegramErrorHook{chatID: cfg.LogTelegramChatID})
+	}
+}
+
+// telegramErrorHook forwards error-level (and above) log entries to a
+// Telegram chat.
+type telegramErrorHook struct {
+	chatID int64
+}
+
+func (h *telegramErrorHook) Levels() []logrus.Level {
+	return logrus.AllLevels[:logrus.ErrorLevel+1]
+}
+
+func (h *telegramErrorHook) Fire(entry *logrus.Entry) error {
+	if botClient == nil {
+		return nil
+	}
+
+	line, err := entry.String()
+	if err != nil {
+		line = entry.Message
+	}
+
+	if sent := botClient.SendMessage(h.chatID, line, nil); !sent.Ok {
+		return nil // avoid recursive logging on failure to notify
+	}
+	return nil
+}
@@ -5,18 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	bot "github.com/meinside/telegram-bot-go"
+
+	"github.com/meinside/telegram-bot-ngrok/pkg/persistence"
 )
 
 const (
@@ -32,8 +33,18 @@ const (
 	commandStart         = "/start"
 	commandLaunchNgrok   = "/launch"
 	commandShutdownNgrok = "/shutdown"
+	commandStatus        = "/status"
+	commandSubscribe     = "/subscribe"
+	commandUnsubscribe   = "/unsubscribe"
+	commandHistory       = "/history"
+	commandShell         = "/run"
+	commandList          = "/list"
 	commandCancel        = "/cancel"
 
+	// for structured logging
+	defaultLogLevel  = "info"
+	defaultLogFormat = "text"
+
 	// messages
 	messageDefault                    = "Welcome!"
 	messageUnknownCommand             = "Unknown command."
@@ -47,9 +58,49 @@ const (
 	messageShutdownSuccessfully       = "Shutdown successfully."
 	messageShutdownSuccessfullyFormat = "Shutdown successfully. (%s)"
 	messageShutdownFailedFormat       = "Failed to shutdown: %s"
-
-	// api url
-	tunnelsAPIURL = "http://localhost:4040/api/tunnels"
+	messageNotLaunchedYet             = "Nothing launched yet."
+	messageSubscribeUsageFormat       = "Usage: %s <tunnel>"
+	messageSubscribedFormat           = "Subscribed to: %s"
+	messageUnsubscribed               = "Unsubscribed from all tunnels."
+	messageUnsubscribedFromFormat     = "Unsubscribed from: %s"
+	messageNoHistory                  = "No history yet."
+	messageNoShellCommands            = "No commands configured."
+	messageWhatToRun                  = "Which command do you want to run?"
+	messageRateLimited                = "Rate limit exceeded. Please wait a moment and try again."
+	messageRunningFormat              = "Running: %s"
+	messageWhatToShutdown             = "Which tunnel do you want to shut down?"
+	messageNoRunningTunnels           = "No tunnels running."
+
+	// callback data prefix for the `/shutdown` instance picker
+	shutdownCallbackPrefix = "shutdown:"
+
+	// for health monitoring
+	defaultHealthCheckIntervalSeconds = 10
+	defaultHealthCheckTimeoutSeconds  = 5
+
+	// for persistence
+	defaultDBFilename  = "ngrok-bot.db"
+	historyPageSize    = 5
+	callbackHistoryFmt = "history:%d"
+
+	// audit actions
+	actionLaunch   = "launch"
+	actionShutdown = "shutdown"
+
+	// for shell command execution
+	defaultExecTimeoutSeconds     = 30
+	defaultExecRateLimitPerMinute = 10
+	shellCallbackPrefix           = "shell:"
+	maxInlineOutputLen            = 4000 // Telegram's message limit is 4096
+	maxChunksBeforeDocument       = 4
+
+	// for webhook mode
+	modePolling               = "polling"
+	modeWebhook               = "webhook"
+	webhookServePath          = "/webhook"
+	defaultWebhookPort        = 8443
+	webhookTunnelWaitInterval = 1 * time.Second
+	webhookTunnelWaitTimeout  = 1 * time.Minute
 )
 
 // struct for config file
@@ -59,7 +110,39 @@ type config struct {
 	AvailableIds    []string          `json:"available_ids"`
 	MonitorInterval int               `json:"monitor_interval"`
 	TunnelParams    map[string]string `json:"tunnel_params"`
-	IsVerbose       bool              `json:"is_verbose"`
+
+	// IsVerbose is deprecated; set LogLevel to "debug" instead.
+	IsVerbose bool `json:"is_verbose"`
+
+	// structured logging
+	LogLevel          string `json:"log_level"`
+	LogFormat         string `json:"log_format"`
+	LogFilePath       string `json:"log_file_path"`
+	LogTelegramChatID int64  `json:"log_telegram_chat_id"`
+
+	// health monitoring of launched tunnels
+	HealthCheckIntervalSeconds int  `json:"health_check_interval_seconds"`
+	HealthCheckTimeoutSeconds  int  `json:"health_check_timeout_seconds"`
+	MaxRestartAttempts         int  `json:"max_restart_attempts"`
+	AlertOnFailure             bool `json:"alert_on_failure"`
+
+	// persistence of tunnel state and per-user preferences
+	DBPath     string `json:"db_path"`
+	AutoResume bool   `json:"auto_resume"`
+
+	// arbitrary shell command execution
+	ShellCommands          map[string]string `json:"shell_commands"`
+	ExecTimeoutSeconds     int               `json:"exec_timeout_seconds"`
+	ExecRateLimitPerMinute int               `json:"exec_rate_limit_per_minute"`
+
+	// webhook mode, as an alternative to long-polling
+	Mode               string `json:"mode"`
+	WebhookURL         string `json:"webhook_url"`
+	WebhookPort        int    `json:"webhook_port"`
+	WebhookCertPath    string `json:"webhook_cert_path"`
+	WebhookKeyPath     string `json:"webhook_key_path"`
+	WebhookViaTunnel   string `json:"webhook_via_tunnel"`
+	WebhookSecretToken string `json:"webhook_secret_token"`
 }
 
 // Read config
@@ -86,9 +169,34 @@ var monitorInterval int
 var tunnelParams map[string]string
 var isVerbose bool
 
+// health monitoring config
+var healthCheckInterval int
+var healthCheckTimeout int
+var maxRestartAttempts int
+var alertOnFailure bool
+
+// persistence config
+var dbPath string
+var autoResume bool
+var store *persistence.Store
+
+// shell command execution config
+var shellCommands map[string]string
+var execTimeoutSeconds int
+var execRateLimitPerMinute int
+
+// webhook mode config
+var mode string
+var webhookURL string
+var webhookPort int
+var webhookCertPath string
+var webhookKeyPath string
+var webhookViaTunnel string
+var webhookSecretToken string
+
 // keyboards
 var allKeyboards = [][]bot.KeyboardButton{
-	bot.NewKeyboardButtons(commandLaunchNgrok, commandShutdownNgrok),
+	bot.NewKeyboardButtons(commandLaunchNgrok, commandShutdownNgrok, commandStatus, commandList),
 }
 
 // https://ngrok.com/docs/2#client-api
@@ -106,15 +214,23 @@ type ngrokTunnel struct {
 	Metrics   map[string]interface{} `json:"metrics"`
 }
 
-var lock sync.Mutex
-var cmd *exec.Cmd = nil
+// manager runs and tracks every currently-launched ngrok process
+var manager = newTunnelManager()
+
+var logger = logrus.New()
+var _stdout = leveledLogger{logger, logrus.InfoLevel}
+var _stderr = leveledLogger{logger, logrus.ErrorLevel}
+
+// bot client, needed by the health supervisor for pushing alerts
+var botClient *bot.Bot
 
-var _stdout = log.New(os.Stdout, "", log.LstdFlags)
-var _stderr = log.New(os.Stderr, "", log.LstdFlags)
+// channel for stopping the health supervisor goroutine
+var stopSupervisor chan bool = nil
 
-// initialization
-func init() {
-	// read variables from config file
+// loadConfig reads the config file into the package-level variables above.
+// It's called explicitly from main() (rather than from an init()) so that
+// package main stays importable by tests without a config.json on disk.
+func loadConfig() {
 	if config, err := getConfig(); err == nil {
 		apiToken = config.APIToken
 		ngrokBinPath = config.NgrokBinPath
@@ -125,6 +241,58 @@ func init() {
 		}
 		tunnelParams = config.TunnelParams
 		isVerbose = config.IsVerbose
+		configureLogging(config)
+		isVerbose = logger.IsLevelEnabled(logrus.DebugLevel) // debug level (or the IsVerbose shim) turns on verbose output
+
+		healthCheckInterval = config.HealthCheckIntervalSeconds
+		if healthCheckInterval <= 0 {
+			healthCheckInterval = defaultHealthCheckIntervalSeconds
+		}
+		healthCheckTimeout = config.HealthCheckTimeoutSeconds
+		if healthCheckTimeout <= 0 {
+			healthCheckTimeout = defaultHealthCheckTimeoutSeconds
+		}
+		maxRestartAttempts = config.MaxRestartAttempts
+		alertOnFailure = config.AlertOnFailure
+
+		dbPath = config.DBPath
+		if len(dbPath) <= 0 {
+			if execFilepath, err := os.Executable(); err == nil {
+				dbPath = filepath.Join(filepath.Dir(execFilepath), defaultDBFilename)
+			} else {
+				dbPath = defaultDBFilename
+			}
+		}
+		autoResume = config.AutoResume
+
+		var storeErr error
+		if store, storeErr = persistence.Open(dbPath); storeErr != nil {
+			panic(storeErr)
+		}
+
+		shellCommands = config.ShellCommands
+		execTimeoutSeconds = config.ExecTimeoutSeconds
+		if execTimeoutSeconds <= 0 {
+			execTimeoutSeconds = defaultExecTimeoutSeconds
+		}
+		execRateLimitPerMinute = config.ExecRateLimitPerMinute
+		if execRateLimitPerMinute <= 0 {
+			execRateLimitPerMinute = defaultExecRateLimitPerMinute
+		}
+
+		mode = config.Mode
+		if len(mode) <= 0 {
+			mode = modePolling
+		}
+		webhookURL = config.WebhookURL
+		webhookPort = config.WebhookPort
+		if webhookPort <= 0 {
+			webhookPort = defaultWebhookPort
+		}
+		webhookCertPath = config.WebhookCertPath
+		webhookKeyPath = config.WebhookKeyPath
+		webhookViaTunnel = config.WebhookViaTunnel
+		webhookSecretToken = config.WebhookSecretToken
 	} else {
 		panic(err)
 	}
@@ -140,12 +308,13 @@ func isAvailableID(id string) bool {
 	return false
 }
 
-// get tunnels' status
-func tunnelsStatus() (ngrokTunnels, error) {
+// get tunnels' status from the ngrok instance listening on `webAddr`
+func tunnelsStatus(webAddr string) (ngrokTunnels, error) {
 	var res *http.Response
 	var err error
 
-	if res, err = http.Get(tunnelsAPIURL); err == nil {
+	url := fmt.Sprintf("http://%s/api/tunnels", webAddr)
+	if res, err = http.Get(url); err == nil {
 		defer res.Body.Close()
 
 		var body []byte
@@ -170,92 +339,25 @@ func tunnelsStatus() (ngrokTunnels, error) {
 	return ngrokTunnels{}, err
 }
 
-// launch ngrok
-func launchNgrok(params ...string) (message string, success bool) {
-	lock.Lock()
-	defer lock.Unlock()
-
-	if cmd != nil {
-		if isVerbose {
-			_stdout.Printf("launch: killing process...")
-		}
-
-		go func() {
-			cmd.Process.Kill()
-		}()
-		cmd.Wait()
-	}
-	cmd = exec.Command(ngrokBinPath, params...)
-
-	if isVerbose {
-		_stdout.Printf("launch: starting process...")
-	}
-
-	var err error
-	if err = cmd.Start(); err == nil {
-		time.Sleep(ngrokLaunchDelaySeconds * time.Second)
-
-		var tunnels ngrokTunnels
-		if tunnels, err = tunnelsStatus(); err == nil {
-			status := ""
-			for _, tunnel := range tunnels.Tunnels {
-				status += fmt.Sprintf("â–¸ %s\n    %s\n", tunnel.Name, tunnel.PublicURL)
-			}
-			if len(status) <= 0 {
-				status = messageNoTunnels
-			}
-			return status, true
-		}
-
-		return fmt.Sprintf("failed to get tunnels status: %s", err), false
-	}
-
-	return fmt.Sprintf("failed to launch: %s", err), false
-}
-
-// shutdown ngrok
-func shutdownNgrok() (message string, success bool) {
-	lock.Lock()
-	defer lock.Unlock()
-
-	if cmd == nil {
-		return fmt.Sprintf(messageShutdownFailedFormat, "no running process"), false
-	}
-
-	if isVerbose {
-		_stdout.Printf("shutdown: killing process...")
-	}
-
-	go func() {
-		cmd.Process.Kill()
-	}()
-
-	var msg string
-	if err := cmd.Wait(); err == nil {
-		msg = messageShutdownSuccessfully
-	} else {
-		msg = fmt.Sprintf(messageShutdownSuccessfullyFormat, err)
-	}
-	cmd = nil
-
-	return msg, true
-}
-
 // process incoming update from Telegram
 func processUpdate(b *bot.Bot, update bot.Update) bool {
 	// check username
 	var userID string
 	if update.Message.From.Username == nil {
-		_stderr.Printf("not allowed (no user name): %s", update.Message.From.FirstName)
+		logger.WithField("user_id", update.Message.From.FirstName).Warn("not allowed (no user name)")
 		return false
 	}
 	userID = *update.Message.From.Username
 	if !isAvailableID(userID) {
-		_stderr.Printf("id not allowed: %s\n", userID)
+		logger.WithField("user_id", userID).Warn("id not allowed")
 
 		return false
 	}
 
+	chatIDsLock.Lock()
+	knownChatIDs[userID] = update.Message.Chat.ID
+	chatIDsLock.Unlock()
+
 	// process result
 	result := false
 
@@ -267,6 +369,8 @@ func processUpdate(b *bot.Bot, update bot.Update) bool {
 		txt = ""
 	}
 
+	logger.WithFields(logrus.Fields{"user_id": userID, "command": txt}).Debug("processing update")
+
 	var message string
 	var options map[string]interface{} = map[string]interface{}{
 		"reply_markup": bot.ReplyKeyboardMarkup{
@@ -315,8 +419,91 @@ func processUpdate(b *bot.Bot, update bot.Update) bool {
 		} else {
 			message = messageNoConfiguredTunnels
 		}
+	// shutdown
 	case strings.HasPrefix(txt, commandShutdownNgrok):
-		message, _ = shutdownNgrok()
+		if instances := manager.List(); len(instances) > 0 {
+			// inline keyboard for picking which running instance to shut down
+			buttons := [][]bot.InlineKeyboardButton{}
+			for _, inst := range instances {
+				data := shutdownCallbackPrefix + inst.ID
+				buttons = append(buttons, []bot.InlineKeyboardButton{
+					{
+						Text:         inst.Name,
+						CallbackData: &data,
+					},
+				})
+			}
+
+			// cancel button
+			cancel := commandCancel
+			buttons = append(buttons, []bot.InlineKeyboardButton{
+				{
+					Text:         messageCancel,
+					CallbackData: &cancel,
+				},
+			})
+
+			options["reply_markup"] = bot.InlineKeyboardMarkup{
+				InlineKeyboard: buttons,
+			}
+
+			message = messageWhatToShutdown
+		} else {
+			message = messageNotLaunchedYet
+		}
+	// status
+	case strings.HasPrefix(txt, commandStatus):
+		message = statusMessage()
+	// list running instances
+	case strings.HasPrefix(txt, commandList):
+		message = listMessage()
+	// subscribe
+	case strings.HasPrefix(txt, commandSubscribe):
+		message = subscribeCommand(userID, strings.TrimSpace(strings.TrimPrefix(txt, commandSubscribe)))
+	// unsubscribe
+	case strings.HasPrefix(txt, commandUnsubscribe):
+		message = unsubscribeCommand(userID, strings.TrimSpace(strings.TrimPrefix(txt, commandUnsubscribe)))
+	// history
+	case strings.HasPrefix(txt, commandHistory):
+		var markup bot.InlineKeyboardMarkup
+		message, markup = historyPage(0)
+		options["reply_markup"] = markup
+	// run a preconfigured shell command
+	case strings.HasPrefix(txt, commandShell):
+		if len(shellCommands) > 0 {
+			buttons := [][]bot.InlineKeyboardButton{}
+			for alias := range shellCommands {
+				data := shellCallbackPrefix + alias
+				buttons = append(buttons, []bot.InlineKeyboardButton{
+					{
+						Text:         alias,
+						CallbackData: &data,
+					},
+				})
+			}
+
+			// cancel button
+			cancel := commandCancel
+			buttons = append(buttons, []bot.InlineKeyboardButton{
+				{
+					Text:         messageCancel,
+					CallbackData: &cancel,
+				},
+			})
+
+			options["reply_markup"] = bot.InlineKeyboardMarkup{
+				InlineKeyboard: buttons,
+			}
+
+			message = messageWhatToRun
+		} else {
+			message = messageNoShellCommands
+		}
+	// direct invocation: "<alias>\n<stdin payload>"
+	case isShellInvocation(txt):
+		alias, stdin := splitAliasAndStdin(txt)
+		runAndReply(b, update.Message.Chat.ID, userID, alias, stdin)
+		return true
 	// fallback
 	default:
 		if len(txt) > 0 {
@@ -330,7 +517,7 @@ func processUpdate(b *bot.Bot, update bot.Update) bool {
 	if sent := b.SendMessage(update.Message.Chat.ID, message, options); sent.Ok {
 		result = true
 	} else {
-		_stderr.Printf("failed to send message: %s", *sent.Description)
+		logger.WithField("user_id", userID).Errorf("failed to send message: %s", *sent.Description)
 	}
 
 	return result
@@ -341,6 +528,31 @@ func processCallbackQuery(b *bot.Bot, update bot.Update) bool {
 	query := *update.CallbackQuery
 	txt := *query.Data
 
+	var userID string
+	if query.From.Username != nil {
+		userID = *query.From.Username
+	}
+	if !isAvailableID(userID) {
+		logger.WithField("user_id", userID).Warn("id not allowed")
+
+		return false
+	}
+
+	// history pagination
+	if strings.HasPrefix(txt, "history:") {
+		return processHistoryCallbackQuery(b, query, txt)
+	}
+
+	// run a preconfigured shell command picked from the inline keyboard
+	if strings.HasPrefix(txt, shellCallbackPrefix) {
+		return processShellCallbackQuery(b, query, strings.TrimPrefix(txt, shellCallbackPrefix), userID)
+	}
+
+	// shut down the instance picked from the `/shutdown` inline keyboard
+	if strings.HasPrefix(txt, shutdownCallbackPrefix) {
+		return processShutdownCallbackQuery(b, query, strings.TrimPrefix(txt, shutdownCallbackPrefix), userID)
+	}
+
 	// process result
 	result := false
 	launchSuccessful := false
@@ -355,14 +567,14 @@ func processCallbackQuery(b *bot.Bot, update bot.Update) bool {
 		if paramStr, exists := tunnelParams[txt]; exists {
 			params := strings.Split(paramStr, " ")
 			if len(params) > 0 {
-				message, launchSuccessful = launchNgrok(params...)
+				_, message, launchSuccessful = manager.Launch(userID, txt, params...)
 			} else {
-				_stderr.Printf("no tunnel parameter")
+				logger.WithFields(logrus.Fields{"user_id": userID, "tunnel": txt}).Error("no tunnel parameter")
 
 				return result // == false
 			}
 		} else {
-			_stderr.Printf("unprocessable callback query: %s", txt)
+			logger.WithFields(logrus.Fields{"user_id": userID, "command": txt}).Error("unprocessable callback query")
 
 			return result // == false
 		}
@@ -390,45 +602,76 @@ func processCallbackQuery(b *bot.Bot, update bot.Update) bool {
 		if apiResult := b.EditMessageText(message, options); apiResult.Ok {
 			result = true
 		} else {
-			_stderr.Printf("failed to edit message text: %s", *apiResult.Description)
+			logger.WithFields(logrus.Fields{"user_id": userID, "tunnel": txt}).Errorf("failed to edit message text: %s", *apiResult.Description)
 		}
 	} else {
-		_stderr.Printf("failed to answer callback query: %+v", query)
+		logger.WithFields(logrus.Fields{"user_id": userID, "tunnel": txt}).Errorf("failed to answer callback query: %+v", query)
 	}
 
 	return result
 }
 
+// dispatch a single update to the message/callback-query processors; shared
+// between polling and webhook modes
+func dispatchUpdate(b *bot.Bot, update bot.Update, err error) {
+	if err == nil {
+		if update.HasMessage() {
+			processUpdate(b, update) // process message
+		} else if update.HasCallbackQuery() {
+			processCallbackQuery(b, update) // process callback query
+		}
+	} else {
+		_stderr.Printf("error while receiving update (%s)", err)
+	}
+}
+
 func main() {
+	loadConfig()
+	defer store.Close()
+
 	// catch SIGINT and SIGTERM and terminate gracefully
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sig
+		haltSupervisor()
+		stopWebhookServer()
+		store.Close()
 		os.Exit(1)
 	}()
 
 	client := bot.NewClient(apiToken)
 	client.Verbose = isVerbose
+	botClient = client
+
+	// start supervising whatever instances are (or become) running
+	restartSupervisor()
+
+	// auto-relaunch the last tunnel, if configured to do so
+	if autoResume {
+		if name, params, ok, err := store.LastTunnel(); err == nil && ok {
+			_stdout.Printf("auto-resume: relaunching %s", name)
+			if _, _, success := manager.Launch("", name, params...); !success {
+				_stderr.Printf("auto-resume: failed to relaunch %s", name)
+			}
+		} else if err != nil {
+			_stderr.Printf("auto-resume: failed to load last tunnel: %s", err)
+		}
+	}
 
 	// get info about this bot
 	if me := client.GetMe(); me.Ok {
 		_stdout.Printf("launching bot: @%s (%s)", *me.Result.Username, me.Result.FirstName)
 
+		if mode == modeWebhook {
+			startWebhookMode(client)
+			return
+		}
+
 		// delete webhook (getting updates will not work when wehbook is set up)
 		if unhooked := client.DeleteWebhook(true); unhooked.Ok {
 			// wait for new updates
-			client.StartMonitoringUpdates(0, monitorInterval, func(b *bot.Bot, update bot.Update, err error) {
-				if err == nil {
-					if update.HasMessage() {
-						processUpdate(b, update) // process message
-					} else if update.HasCallbackQuery() {
-						processCallbackQuery(b, update) // process callback query
-					}
-				} else {
-					_stderr.Printf("error while receiving update (%s)", err)
-				}
-			})
+			client.StartMonitoringUpdates(0, monitorInterval, dispatchUpdate)
 		} else {
 			panic("failed to delete webhook")
 		}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	bot "github.com/meinside/telegram-bot-go"
+)
+
+// ngrok's own default web interface listens on 4040; managed instances each
+// get their own port above that so they can run concurrently.
+const ngrokWebAddrBasePort = 4041
+
+// tunnelInstance is a single running (or just-launched) ngrok process.
+type tunnelInstance struct {
+	ID           string
+	Name         string
+	Params       []string
+	WebAddr      string
+	Cmd          *exec.Cmd
+	LaunchedAt   time.Time
+	RestartCount int
+}
+
+// tunnelManager runs and tracks zero or more concurrent ngrok processes,
+// each with its own `--web-addr` so their local APIs don't collide.
+type tunnelManager struct {
+	mu            sync.Mutex
+	instances     map[string]*tunnelInstance // keyed by instance id
+	nextID        int
+	nextPort      int
+	restartCounts map[string]int // keyed by tunnel name
+}
+
+func newTunnelManager() *tunnelManager {
+	return &tunnelManager{
+		instances:     map[string]*tunnelInstance{},
+		nextPort:      ngrokWebAddrBasePort,
+		restartCounts: map[string]int{},
+	}
+}
+
+// Launch starts a new ngrok process for `name`, killing any instance
+// already running under that name first. It does not affect other running
+// instances, and doesn't hold the lock for the launch/shutdown itself so
+// that other tunnels aren't blocked while this one starts up.
+func (m *tunnelManager) Launch(userID, name string, params ...string) (id, message string, success bool) {
+	m.mu.Lock()
+	var toStop []*tunnelInstance
+	for existingID, inst := range m.instances {
+		if inst.Name == name {
+			delete(m.instances, existingID)
+			toStop = append(toStop, inst)
+		}
+	}
+	m.restartCounts[name] = 0
+	m.mu.Unlock()
+
+	for _, inst := range toStop {
+		m.stop(userID, inst)
+	}
+
+	return m.launch(userID, name, params...)
+}
+
+// AttemptRestart is like Launch, but counts against `maxRestartAttempts` for
+// `inst.Name` instead of resetting it; used by the health supervisor.
+func (m *tunnelManager) AttemptRestart(inst *tunnelInstance) (id, message string, success bool) {
+	m.mu.Lock()
+	current, exists := m.instances[inst.ID]
+	if !exists {
+		m.mu.Unlock()
+		// already gone, e.g. a user shut it down while this health check
+		// was in flight; don't resurrect a tunnel that was shut down on purpose
+		return "", "instance no longer running; not restarting", false
+	}
+	if maxRestartAttempts > 0 && m.restartCounts[inst.Name] >= maxRestartAttempts {
+		m.mu.Unlock()
+		return "", "max restart attempts reached", false
+	}
+	m.restartCounts[inst.Name]++
+	delete(m.instances, inst.ID)
+	m.mu.Unlock()
+
+	m.stop("", current)
+
+	return m.launch("", inst.Name, inst.Params...)
+}
+
+// launch starts the ngrok process itself; only the brief id/port allocation
+// and the final map insertion are done under `m.mu` — the sleep, the HTTP
+// probe, and persistence/notification all happen unlocked.
+func (m *tunnelManager) launch(userID, name string, params ...string) (id, message string, success bool) {
+	m.mu.Lock()
+	m.nextID++
+	id = fmt.Sprintf("t%d", m.nextID)
+	m.nextPort++
+	webAddr := fmt.Sprintf("127.0.0.1:%d", m.nextPort)
+	m.mu.Unlock()
+
+	fullParams := append(append([]string{}, params...), "--web-addr", webAddr)
+
+	logFields := logrus.Fields{"user_id": userID, "tunnel": name, "command": strings.Join(fullParams, " ")}
+	logger.WithFields(logFields).Debug("launch: starting process...")
+
+	c := exec.Command(ngrokBinPath, fullParams...)
+	if err := c.Start(); err != nil {
+		message = fmt.Sprintf("failed to launch: %s", err)
+		logger.WithFields(logFields).Error(message)
+		recordFailure(userID, name, message)
+		return "", message, false
+	}
+	logFields["pid"] = c.Process.Pid
+
+	time.Sleep(ngrokLaunchDelaySeconds * time.Second)
+
+	tunnels, err := tunnelsStatus(webAddr)
+	if err != nil {
+		message = fmt.Sprintf("failed to get tunnels status: %s", err)
+		logger.WithFields(logFields).Error(message)
+		recordFailure(userID, name, message)
+
+		go c.Process.Kill()
+		return "", message, false
+	}
+
+	inst := &tunnelInstance{
+		ID:         id,
+		Name:       name,
+		Params:     params,
+		WebAddr:    webAddr,
+		Cmd:        c,
+		LaunchedAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	m.instances[id] = inst
+	m.mu.Unlock()
+
+	message = formatTunnels(tunnels)
+
+	logger.WithFields(logFields).Info("launched ngrok")
+	recordLaunch(userID, name, params, message)
+
+	return id, message, true
+}
+
+// Shutdown stops the instance identified by `id`.
+func (m *tunnelManager) Shutdown(userID, id string) (message string, success bool) {
+	m.mu.Lock()
+	inst, exists := m.instances[id]
+	if exists {
+		delete(m.instances, id)
+	}
+	m.mu.Unlock()
+
+	if !exists {
+		return fmt.Sprintf(messageShutdownFailedFormat, "no running instance"), false
+	}
+
+	return m.stop(userID, inst), true
+}
+
+// stop kills `inst`'s process and records the outcome; it must be called
+// with `m.mu` already released and `inst` already removed from `m.instances`.
+func (m *tunnelManager) stop(userID string, inst *tunnelInstance) (message string) {
+	logFields := logrus.Fields{"user_id": userID, "tunnel": inst.Name, "pid": inst.Cmd.Process.Pid}
+	logger.WithFields(logFields).Debug("shutdown: killing process...")
+
+	go inst.Cmd.Process.Kill()
+
+	if err := inst.Cmd.Wait(); err == nil {
+		message = messageShutdownSuccessfully
+	} else {
+		message = fmt.Sprintf(messageShutdownSuccessfullyFormat, err)
+	}
+
+	logger.WithFields(logFields).Info(message)
+	recordShutdown(userID, inst.Name, message)
+
+	return message
+}
+
+// List returns a snapshot of running instances, sorted by id.
+func (m *tunnelManager) List() []*tunnelInstance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*tunnelInstance, 0, len(m.instances))
+	for _, inst := range m.instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// Get returns the instance identified by `id`, if it's running.
+func (m *tunnelManager) Get(id string) (inst *tunnelInstance, exists bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inst, exists = m.instances[id]
+	return inst, exists
+}
+
+// FindTunnel looks up a public URL for a tunnel named `name` across all
+// managed instances.
+func (m *tunnelManager) FindTunnel(name string) (publicURL string, found bool) {
+	for _, inst := range m.List() {
+		tunnels, err := tunnelsStatus(inst.WebAddr)
+		if err != nil {
+			continue
+		}
+		for _, tunnel := range tunnels.Tunnels {
+			if tunnel.Name == name {
+				return tunnel.PublicURL, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// format a tunnels API response into the bullet list shown to users
+func formatTunnels(tunnels ngrokTunnels) string {
+	status := ""
+	for _, tunnel := range tunnels.Tunnels {
+		status += fmt.Sprintf("â–¸ %s\n    %s\n", tunnel.Name, tunnel.PublicURL)
+	}
+	if len(status) <= 0 {
+		status = messageNoTunnels
+	}
+	return status
+}
+
+// handle a `shutdown:<id>` callback query from the `/shutdown` instance picker
+func processShutdownCallbackQuery(b *bot.Bot, query bot.CallbackQuery, id, userID string) bool {
+	message, _ := manager.Shutdown(userID, id)
+
+	if apiResult := b.AnswerCallbackQuery(query.ID, map[string]interface{}{}); !apiResult.Ok {
+		_stderr.Printf("failed to answer callback query: %+v", query)
+		return false
+	}
+
+	options := map[string]interface{}{
+		"chat_id":    query.Message.Chat.ID,
+		"message_id": query.Message.MessageID,
+	}
+	if apiResult := b.EditMessageText(message, options); !apiResult.Ok {
+		_stderr.Printf("failed to edit message text: %s", *apiResult.Description)
+		return false
+	}
+
+	return true
+}
+
+// build the message for the `/list` command: every running instance with
+// its public URL(s) and PID
+func listMessage() string {
+	instances := manager.List()
+	if len(instances) <= 0 {
+		return messageNoRunningTunnels
+	}
+
+	lines := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		pid := 0
+		if inst.Cmd != nil && inst.Cmd.Process != nil {
+			pid = inst.Cmd.Process.Pid
+		}
+
+		urls := []string{}
+		if tunnels, err := tunnelsStatus(inst.WebAddr); err == nil {
+			for _, tunnel := range tunnels.Tunnels {
+				urls = append(urls, tunnel.PublicURL)
+			}
+		}
+		if len(urls) <= 0 {
+			urls = append(urls, "(no public url yet)")
+		}
+
+		lines = append(lines, fmt.Sprintf("â–¸ %s (id: %s, pid: %d)\n    %s", inst.Name, inst.ID, pid, strings.Join(urls, "\n    ")))
+	}
+
+	return strings.Join(lines, "\n")
+}
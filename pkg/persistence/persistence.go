@@ -0,0 +1,172 @@
+// Package persistence provides a SQLite-backed store for tunnel state and
+// per-user preferences that needs to survive bot restarts.
+package persistence
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	schema = `
+CREATE TABLE IF NOT EXISTS last_tunnel (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	name TEXT NOT NULL,
+	params TEXT NOT NULL,
+	launched_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS subscriptions (
+	user_id TEXT NOT NULL,
+	tunnel TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, tunnel)
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	tunnel TEXT NOT NULL,
+	result TEXT NOT NULL,
+	timestamp DATETIME NOT NULL
+);
+`
+
+	paramsSeparator = "\x1f" // unit separator, unlikely to appear in a param
+)
+
+// Store wraps the SQLite-backed persistence layer.
+type Store struct {
+	db *sql.DB
+}
+
+// AuditEntry is a single recorded launch/shutdown action.
+type AuditEntry struct {
+	UserID    string
+	Action    string
+	Tunnel    string
+	Result    string
+	Timestamp time.Time
+}
+
+// Open opens (and initializes, if needed) the SQLite database at `path`.
+func Open(path string) (store *Store, err error) {
+	var db *sql.DB
+	if db, err = sql.Open("sqlite3", path); err == nil {
+		if _, err = db.Exec(schema); err == nil {
+			return &Store{db: db}, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SaveLastTunnel records the most recently launched tunnel name and params,
+// so the bot can auto-relaunch it on startup.
+func (s *Store) SaveLastTunnel(name string, params []string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO last_tunnel (id, name, params, launched_at) VALUES (1, ?, ?, ?)
+		 ON CONFLICT (id) DO UPDATE SET name = excluded.name, params = excluded.params, launched_at = excluded.launched_at`,
+		name, strings.Join(params, paramsSeparator), time.Now(),
+	)
+	return err
+}
+
+// LastTunnel returns the most recently launched tunnel name and params.
+// `ok` is false when nothing has been launched yet.
+func (s *Store) LastTunnel() (name string, params []string, ok bool, err error) {
+	var paramsStr string
+	row := s.db.QueryRow(`SELECT name, params FROM last_tunnel WHERE id = 1`)
+	if err = row.Scan(&name, &paramsStr); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, false, nil
+		}
+		return "", nil, false, err
+	}
+
+	if len(paramsStr) > 0 {
+		params = strings.Split(paramsStr, paramsSeparator)
+	}
+	return name, params, true, nil
+}
+
+// Subscribe adds `userID`'s subscription to lifecycle events of `tunnel`.
+func (s *Store) Subscribe(userID, tunnel string) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO subscriptions (user_id, tunnel, created_at) VALUES (?, ?, ?)`,
+		userID, tunnel, time.Now(),
+	)
+	return err
+}
+
+// Unsubscribe removes `userID`'s subscription to `tunnel`. If `tunnel` is
+// empty, all of the user's subscriptions are removed.
+func (s *Store) Unsubscribe(userID, tunnel string) error {
+	if len(tunnel) > 0 {
+		_, err := s.db.Exec(`DELETE FROM subscriptions WHERE user_id = ? AND tunnel = ?`, userID, tunnel)
+		return err
+	}
+
+	_, err := s.db.Exec(`DELETE FROM subscriptions WHERE user_id = ?`, userID)
+	return err
+}
+
+// Subscribers returns the ids of users subscribed to `tunnel`'s events.
+func (s *Store) Subscribers(tunnel string) (userIDs []string, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query(`SELECT user_id FROM subscriptions WHERE tunnel = ?`, tunnel); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// LogAudit records a launch/shutdown action for later review via `/history`.
+func (s *Store) LogAudit(userID, action, tunnel, result string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO audit_log (user_id, action, tunnel, result, timestamp) VALUES (?, ?, ?, ?, ?)`,
+		userID, action, tunnel, result, time.Now(),
+	)
+	return err
+}
+
+// AuditEntries returns up to `limit` audit entries starting at `offset`,
+// newest first, along with the total number of recorded entries.
+func (s *Store) AuditEntries(offset, limit int) (entries []AuditEntry, total int, err error) {
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM audit_log`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	var rows *sql.Rows
+	if rows, err = s.db.Query(
+		`SELECT user_id, action, tunnel, result, timestamp FROM audit_log ORDER BY id DESC LIMIT ? OFFSET ?`,
+		limit, offset,
+	); err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		if err = rows.Scan(&e.UserID, &e.Action, &e.Tunnel, &e.Result, &e.Timestamp); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestLastTunnel(t *testing.T) {
+	store := openTestStore(t)
+
+	if _, _, ok, err := store.LastTunnel(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if ok {
+		t.Fatalf("expected ok = false before anything is saved")
+	}
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"first", []string{"http", "8080"}},
+		{"second", []string{"tcp", "22"}}, // overwrites "first"
+	}
+
+	for _, test := range tests {
+		if err := store.SaveLastTunnel(test.name, test.params); err != nil {
+			t.Fatalf("failed to save last tunnel: %s", err)
+		}
+
+		name, params, ok, err := store.LastTunnel()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok {
+			t.Fatalf("expected ok = true after saving")
+		}
+		if name != test.name {
+			t.Errorf("name = %q, want %q", name, test.name)
+		}
+		if len(params) != len(test.params) {
+			t.Fatalf("params = %v, want %v", params, test.params)
+		}
+		for i, p := range test.params {
+			if params[i] != p {
+				t.Errorf("params[%d] = %q, want %q", i, params[i], p)
+			}
+		}
+	}
+}
+
+func TestSubscribeReplacesNotDuplicates(t *testing.T) {
+	store := openTestStore(t)
+
+	if err := store.Subscribe("alice", "tunnel-a"); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	if err := store.Subscribe("alice", "tunnel-a"); err != nil { // re-subscribe, should not duplicate
+		t.Fatalf("failed to re-subscribe: %s", err)
+	}
+	if err := store.Subscribe("bob", "tunnel-a"); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	subscribers, err := store.Subscribers("tunnel-a")
+	if err != nil {
+		t.Fatalf("failed to fetch subscribers: %s", err)
+	}
+	if len(subscribers) != 2 {
+		t.Fatalf("subscribers = %v, want 2 distinct entries", subscribers)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	store := openTestStore(t)
+
+	if err := store.Subscribe("alice", "tunnel-a"); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	if err := store.Subscribe("alice", "tunnel-b"); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	// unsubscribing from a single tunnel leaves the others intact
+	if err := store.Unsubscribe("alice", "tunnel-a"); err != nil {
+		t.Fatalf("failed to unsubscribe: %s", err)
+	}
+	if subscribers, err := store.Subscribers("tunnel-a"); err != nil {
+		t.Fatalf("failed to fetch subscribers: %s", err)
+	} else if len(subscribers) != 0 {
+		t.Fatalf("subscribers of tunnel-a = %v, want none", subscribers)
+	}
+	if subscribers, err := store.Subscribers("tunnel-b"); err != nil {
+		t.Fatalf("failed to fetch subscribers: %s", err)
+	} else if len(subscribers) != 1 {
+		t.Fatalf("subscribers of tunnel-b = %v, want 1", subscribers)
+	}
+
+	// unsubscribing with no tunnel removes everything for that user
+	if err := store.Unsubscribe("alice", ""); err != nil {
+		t.Fatalf("failed to unsubscribe from all: %s", err)
+	}
+	if subscribers, err := store.Subscribers("tunnel-b"); err != nil {
+		t.Fatalf("failed to fetch subscribers: %s", err)
+	} else if len(subscribers) != 0 {
+		t.Fatalf("subscribers of tunnel-b = %v, want none after unsubscribing from all", subscribers)
+	}
+}
+
+func TestAuditEntriesPagination(t *testing.T) {
+	store := openTestStore(t)
+
+	const count = 7
+	for i := 0; i < count; i++ {
+		if err := store.LogAudit("alice", actionForIndex(i), "tunnel-a", "ok"); err != nil {
+			t.Fatalf("failed to log audit entry: %s", err)
+		}
+	}
+
+	tests := []struct {
+		offset, limit int
+		wantLen       int
+	}{
+		{0, 5, 5},
+		{5, 5, 2},
+		{7, 5, 0},
+	}
+
+	for _, test := range tests {
+		entries, total, err := store.AuditEntries(test.offset, test.limit)
+		if err != nil {
+			t.Fatalf("failed to load audit entries: %s", err)
+		}
+		if total != count {
+			t.Errorf("total = %d, want %d", total, count)
+		}
+		if len(entries) != test.wantLen {
+			t.Errorf("offset=%d limit=%d: len(entries) = %d, want %d", test.offset, test.limit, len(entries), test.wantLen)
+		}
+	}
+
+	// newest first: the very first page should start with the last-logged action
+	entries, _, err := store.AuditEntries(0, 1)
+	if err != nil {
+		t.Fatalf("failed to load audit entries: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Action != actionForIndex(count-1) {
+		t.Fatalf("first entry = %+v, want action %q", entries, actionForIndex(count-1))
+	}
+}
+
+func actionForIndex(i int) string {
+	return "action" + string(rune('0'+i))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bot "github.com/meinside/telegram-bot-go"
+)
+
+// per-user rate limiting of shell command executions
+var rateLimiterLock sync.Mutex
+var recentRuns = map[string][]time.Time{}
+
+// returns whether `userID` is still within `execRateLimitPerMinute`
+func allowedToRun(userID string) bool {
+	rateLimiterLock.Lock()
+	defer rateLimiterLock.Unlock()
+
+	cutoff := time.Now().Add(-time.Minute)
+	kept := recentRuns[userID][:0]
+	for _, t := range recentRuns[userID] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+
+	if len(kept) >= execRateLimitPerMinute {
+		recentRuns[userID] = kept
+		return false
+	}
+
+	recentRuns[userID] = append(kept, time.Now())
+	return true
+}
+
+// returns whether `txt`'s first line names a configured shell command alias
+func isShellInvocation(txt string) bool {
+	alias, _ := splitAliasAndStdin(txt)
+	_, exists := shellCommands[alias]
+	return exists
+}
+
+// splits `txt` into its first line (the alias) and the rest (piped to stdin)
+func splitAliasAndStdin(txt string) (alias, stdin string) {
+	if idx := strings.IndexByte(txt, '\n'); idx >= 0 {
+		return strings.TrimSpace(txt[:idx]), txt[idx+1:]
+	}
+	return strings.TrimSpace(txt), ""
+}
+
+// run the shell command mapped to `alias` with `stdin` piped to it, killing
+// the whole process group if it runs longer than `execTimeoutSeconds`
+func runShellCommand(alias, stdin string) (output string, err error) {
+	cmdStr := shellCommands[alias]
+
+	c := exec.Command("sh", "-c", cmdStr)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if len(stdin) > 0 {
+		c.Stdin = strings.NewReader(stdin)
+	}
+
+	var combined bytes.Buffer
+	c.Stdout = &combined
+	c.Stderr = &combined
+
+	if err = c.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+
+	select {
+	case err = <-done:
+		return combined.String(), err
+	case <-time.After(time.Duration(execTimeoutSeconds) * time.Second):
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done // wait for c.Wait() to reap it before returning
+		return combined.String(), fmt.Errorf("command timed out after %d seconds", execTimeoutSeconds)
+	}
+}
+
+// run `alias` (with optional `stdin`) and reply with its output, chunking
+// long output into multiple messages or uploading it as a document
+func runAndReply(b *bot.Bot, chatID bot.ChatID, userID, alias, stdin string) {
+	if !allowedToRun(userID) {
+		b.SendMessage(chatID, messageRateLimited, nil)
+		return
+	}
+
+	if _, exists := shellCommands[alias]; !exists {
+		_stderr.Printf("unknown shell command alias: %s", alias)
+		return
+	}
+
+	output, err := runShellCommand(alias, stdin)
+	if err != nil {
+		output = fmt.Sprintf("%s\n(error: %s)", output, err)
+	}
+	if len(output) <= 0 {
+		output = "(no output)"
+	}
+
+	switch {
+	case len(output) <= maxInlineOutputLen:
+		b.SendMessage(chatID, output, nil)
+	case len(output) <= maxInlineOutputLen*maxChunksBeforeDocument:
+		for len(output) > 0 {
+			end := maxInlineOutputLen
+			if end > len(output) {
+				end = len(output)
+			}
+			b.SendMessage(chatID, output[:end], nil)
+			output = output[end:]
+		}
+	default:
+		b.SendDocument(chatID, bot.InputFile{Bytes: []byte(output)}, bot.OptionsSendDocument{}.SetCaption(fmt.Sprintf("output of: %s", alias)))
+	}
+}
+
+// handle a `shell:<alias>` callback query from the `/run` inline keyboard
+func processShellCallbackQuery(b *bot.Bot, query bot.CallbackQuery, alias, userID string) bool {
+	if apiResult := b.AnswerCallbackQuery(query.ID, map[string]interface{}{}); !apiResult.Ok {
+		_stderr.Printf("failed to answer callback query: %+v", query)
+		return false
+	}
+
+	options := map[string]interface{}{
+		"chat_id":    query.Message.Chat.ID,
+		"message_id": query.Message.MessageID,
+	}
+	if apiResult := b.EditMessageText(fmt.Sprintf(messageRunningFormat, alias), options); !apiResult.Ok {
+		_stderr.Printf("failed to edit message text: %s", *apiResult.Description)
+	}
+
+	runAndReply(b, query.Message.Chat.ID, userID, alias, "")
+
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowedToRun(t *testing.T) {
+	origLimit := execRateLimitPerMinute
+	origRuns := recentRuns
+	t.Cleanup(func() {
+		execRateLimitPerMinute = origLimit
+		recentRuns = origRuns
+	})
+
+	execRateLimitPerMinute = 3
+	recentRuns = map[string][]time.Time{}
+
+	const userID = "alice"
+
+	for i := 0; i < execRateLimitPerMinute; i++ {
+		if !allowedToRun(userID) {
+			t.Fatalf("run %d: expected to be allowed within the limit", i+1)
+		}
+	}
+	if allowedToRun(userID) {
+		t.Fatalf("expected the run past the limit to be denied")
+	}
+
+	// a different user has their own, independent window
+	if !allowedToRun("bob") {
+		t.Fatalf("expected a different user's first run to be allowed")
+	}
+
+	// entries older than a minute no longer count against the limit
+	recentRuns[userID] = []time.Time{
+		time.Now().Add(-2 * time.Minute),
+		time.Now().Add(-90 * time.Second),
+	}
+	if !allowedToRun(userID) {
+		t.Fatalf("expected stale entries to have aged out of the window")
+	}
+}
+
+func TestRunShellCommandTimeout(t *testing.T) {
+	origCommands := shellCommands
+	origTimeout := execTimeoutSeconds
+	t.Cleanup(func() {
+		shellCommands = origCommands
+		execTimeoutSeconds = origTimeout
+	})
+
+	shellCommands = map[string]string{"sleep": "sleep 5"}
+	execTimeoutSeconds = 1
+
+	start := time.Now()
+	output, err := runShellCommand("sleep", "")
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v, want a timeout error", err)
+	}
+	if elapsed >= 5*time.Second {
+		t.Fatalf("elapsed = %s, expected the process to be killed well before its own sleep finished", elapsed)
+	}
+	_ = output
+}
+
+func TestRunShellCommandCompletesWithinTimeout(t *testing.T) {
+	origCommands := shellCommands
+	origTimeout := execTimeoutSeconds
+	t.Cleanup(func() {
+		shellCommands = origCommands
+		execTimeoutSeconds = origTimeout
+	})
+
+	shellCommands = map[string]string{"echo": "echo hello"}
+	execTimeoutSeconds = 5
+
+	output, err := runShellCommand("echo", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.TrimSpace(output) != "hello" {
+		t.Fatalf("output = %q, want %q", output, "hello")
+	}
+}
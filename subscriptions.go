@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	bot "github.com/meinside/telegram-bot-go"
+)
+
+// record a successful launch: persist it as the last tunnel, audit it, and
+// notify subscribers of the tunnel
+func recordLaunch(userID, name string, params []string, status string) {
+	if err := store.SaveLastTunnel(name, params); err != nil {
+		_stderr.Printf("failed to save last tunnel: %s", err)
+	}
+	if err := store.LogAudit(userID, actionLaunch, name, status); err != nil {
+		_stderr.Printf("failed to log audit entry: %s", err)
+	}
+
+	notifySubscribers(name, fmt.Sprintf("launched: %s", status))
+}
+
+// record a failed launch attempt
+func recordFailure(userID, name, reason string) {
+	if err := store.LogAudit(userID, actionLaunch, name, reason); err != nil {
+		_stderr.Printf("failed to log audit entry: %s", err)
+	}
+
+	notifySubscribers(name, fmt.Sprintf("failed: %s", reason))
+}
+
+// record a shutdown
+func recordShutdown(userID, name, result string) {
+	if err := store.LogAudit(userID, actionShutdown, name, result); err != nil {
+		_stderr.Printf("failed to log audit entry: %s", err)
+	}
+
+	notifySubscribers(name, fmt.Sprintf("shutdown: %s", result))
+}
+
+// push `message` to every subscriber of `tunnel` that has a known chat id
+func notifySubscribers(tunnel, message string) {
+	if botClient == nil || len(tunnel) <= 0 {
+		return
+	}
+
+	subscribers, err := store.Subscribers(tunnel)
+	if err != nil {
+		_stderr.Printf("failed to fetch subscribers of %s: %s", tunnel, err)
+		return
+	}
+
+	chatIDsLock.Lock()
+	defer chatIDsLock.Unlock()
+
+	for _, userID := range subscribers {
+		if chatID, exists := knownChatIDs[userID]; exists {
+			if sent := botClient.SendMessage(chatID, fmt.Sprintf("[%s] %s", tunnel, message), nil); !sent.Ok {
+				_stderr.Printf("failed to notify subscriber %s: %s", userID, *sent.Description)
+			}
+		}
+	}
+}
+
+// handle `/subscribe <tunnel>`
+func subscribeCommand(userID, tunnel string) string {
+	if len(tunnel) <= 0 {
+		return fmt.Sprintf(messageSubscribeUsageFormat, commandSubscribe)
+	}
+
+	if err := store.Subscribe(userID, tunnel); err != nil {
+		return fmt.Sprintf("failed to subscribe: %s", err)
+	}
+
+	return fmt.Sprintf(messageSubscribedFormat, tunnel)
+}
+
+// handle `/unsubscribe [tunnel]`; unsubscribes from everything when no
+// tunnel is given
+func unsubscribeCommand(userID, tunnel string) string {
+	if err := store.Unsubscribe(userID, tunnel); err != nil {
+		return fmt.Sprintf("failed to unsubscribe: %s", err)
+	}
+
+	if len(tunnel) <= 0 {
+		return messageUnsubscribed
+	}
+	return fmt.Sprintf(messageUnsubscribedFromFormat, tunnel)
+}
+
+// build the message and prev/next inline keyboard for a page of `/history`
+func historyPage(offset int) (message string, markup bot.InlineKeyboardMarkup) {
+	entries, total, err := store.AuditEntries(offset, historyPageSize)
+	if err != nil {
+		return fmt.Sprintf("failed to load history: %s", err), markup
+	}
+	if total <= 0 {
+		return messageNoHistory, markup
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("%s %s %s by %s: %s",
+			e.Timestamp.Format("2006-01-02 15:04:05"), e.Action, e.Tunnel, e.UserID, e.Result))
+	}
+	message = strings.Join(lines, "\n")
+
+	buttons := []bot.InlineKeyboardButton{}
+	if offset > 0 {
+		prevOffset := offset - historyPageSize
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		data := fmt.Sprintf(callbackHistoryFmt, prevOffset)
+		buttons = append(buttons, bot.InlineKeyboardButton{Text: "« prev", CallbackData: &data})
+	}
+	if offset+historyPageSize < total {
+		data := fmt.Sprintf(callbackHistoryFmt, offset+historyPageSize)
+		buttons = append(buttons, bot.InlineKeyboardButton{Text: "next »", CallbackData: &data})
+	}
+	if len(buttons) > 0 {
+		markup.InlineKeyboard = [][]bot.InlineKeyboardButton{buttons}
+	}
+
+	return message, markup
+}
+
+// handle a `history:<offset>` callback query from the prev/next buttons
+func processHistoryCallbackQuery(b *bot.Bot, query bot.CallbackQuery, data string) bool {
+	offset, err := strconv.Atoi(strings.TrimPrefix(data, "history:"))
+	if err != nil {
+		offset = 0
+	}
+
+	message, markup := historyPage(offset)
+
+	if apiResult := b.AnswerCallbackQuery(query.ID, map[string]interface{}{}); !apiResult.Ok {
+		_stderr.Printf("failed to answer callback query: %+v", query)
+		return false
+	}
+
+	options := map[string]interface{}{
+		"chat_id":      query.Message.Chat.ID,
+		"message_id":   query.Message.MessageID,
+		"reply_markup": markup,
+	}
+	if apiResult := b.EditMessageText(message, options); !apiResult.Ok {
+		_stderr.Printf("failed to edit message text: %s", *apiResult.Description)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+
+	bot "github.com/meinside/telegram-bot-go"
+)
+
+// the running webhook server, if any; used for graceful shutdown on signal
+var webhookServer *http.Server
+
+// startWebhookMode registers the webhook with Telegram and serves incoming
+// updates over HTTP(S) until the process is terminated.
+func startWebhookMode(client *bot.Bot) {
+	url := webhookURL
+	if len(webhookViaTunnel) > 0 {
+		publicURL, err := waitForTunnelURL(webhookViaTunnel, webhookTunnelWaitTimeout)
+		if err != nil {
+			panic(fmt.Sprintf("webhook: failed to wait for tunnel '%s': %s", webhookViaTunnel, err))
+		}
+		url = publicURL + webhookServePath
+	}
+	if len(url) <= 0 {
+		panic("webhook: no webhook url configured (set `webhook_url` or `webhook_via_tunnel`)")
+	}
+
+	if len(webhookSecretToken) <= 0 {
+		_stderr.Printf("webhook: no `webhook_secret_token` configured; the endpoint will accept unauthenticated requests")
+	}
+
+	if ok, err := registerWebhook(url, webhookCertPath, webhookSecretToken); !ok {
+		panic(fmt.Sprintf("webhook: failed to register webhook: %s", err))
+	}
+	_stdout.Printf("webhook: registered at %s", url)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookServePath, func(w http.ResponseWriter, r *http.Request) {
+		// Telegram echoes the `secret_token` set in registerWebhook back on
+		// this header with every request; reject anything that doesn't match
+		// so forged updates can't bypass `isAvailableID`.
+		if len(webhookSecretToken) > 0 && r.Header.Get("X-Telegram-Bot-Api-Secret-Token") != webhookSecretToken {
+			_stderr.Printf("webhook: rejected request with invalid secret token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update bot.Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			_stderr.Printf("webhook: failed to decode update: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dispatchUpdate(client, update, nil)
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	webhookServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", webhookPort),
+		Handler: mux,
+	}
+
+	_stdout.Printf("webhook: listening on port %d", webhookPort)
+
+	var err error
+	if len(webhookCertPath) > 0 && len(webhookKeyPath) > 0 {
+		err = webhookServer.ListenAndServeTLS(webhookCertPath, webhookKeyPath)
+	} else {
+		err = webhookServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		panic(fmt.Sprintf("webhook: server failed: %s", err))
+	}
+}
+
+// stopWebhookServer gracefully shuts the webhook server down, if it's running.
+func stopWebhookServer() {
+	if webhookServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := webhookServer.Shutdown(ctx); err != nil {
+		_stderr.Printf("webhook: failed to shut down gracefully: %s", err)
+	}
+}
+
+// registerWebhook calls Telegram's `setWebhook` API directly with `url`,
+// optionally uploading a self-signed certificate and/or a `secretToken`
+// that Telegram will echo back on the `X-Telegram-Bot-Api-Secret-Token`
+// header of every request, so the handler can reject forged updates.
+func registerWebhook(url, certPath, secretToken string) (ok bool, err error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	if err = writer.WriteField("url", url); err != nil {
+		return false, err
+	}
+
+	if len(secretToken) > 0 {
+		if err = writer.WriteField("secret_token", secretToken); err != nil {
+			return false, err
+		}
+	}
+
+	if len(certPath) > 0 {
+		var file *os.File
+		if file, err = os.Open(certPath); err != nil {
+			return false, err
+		}
+		defer file.Close()
+
+		var part io.Writer
+		if part, err = writer.CreateFormFile("certificate", certPath); err != nil {
+			return false, err
+		}
+		if _, err = io.Copy(part, file); err != nil {
+			return false, err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return false, err
+	}
+
+	reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/setWebhook", apiToken)
+	res, err := http.Post(reqURL, writer.FormDataContentType(), &body)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	var parsed struct {
+		Ok          bool    `json:"ok"`
+		Description *string `json:"description"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return false, err
+	}
+	if !parsed.Ok {
+		desc := ""
+		if parsed.Description != nil {
+			desc = *parsed.Description
+		}
+		return false, fmt.Errorf("%s", desc)
+	}
+
+	return true, nil
+}
+
+// waitForTunnelURL polls the managed instances until a tunnel named `name`
+// appears, or `timeout` elapses.
+func waitForTunnelURL(name string, timeout time.Duration) (publicURL string, err error) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if url, found := manager.FindTunnel(name); found {
+			return url, nil
+		}
+
+		time.Sleep(webhookTunnelWaitInterval)
+	}
+
+	return "", fmt.Errorf("timed out waiting for tunnel '%s'", name)
+}